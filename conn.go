@@ -27,8 +27,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/forkkit/babelcast/estimator"
 	"github.com/gorilla/websocket"
 	"github.com/pion/ice"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v2"
@@ -41,11 +43,92 @@ import (
 	_ "go.nanomsg.org/mangos/v3/transport/inproc"
 )
 
+// lossLogInterval rate-limits the "high loss" warning so a struggling
+// subscriber doesn't flood the log once per RTCP report.
+const lossLogInterval = 10 * time.Second
+
 const maxLate = 50 // number of packets to skip
 
+// sampleQueueLen bounds how many samples a subscriber's per-track consumer
+// can fall behind by before the bus read loop starts dropping its samples
+// rather than blocking on track.WriteSample.
+const sampleQueueLen = 50
+
 // channel name should NOT match the negation of valid characters
 var channelRegexp = regexp.MustCompile("[^a-zA-Z0-9 ]+")
 
+// trackKind identifies which media track a sample belongs to once it is
+// multiplexed onto the shared pub/sub bus. It rides in a single byte
+// immediately after the topic hash so a subscriber can demux samples back
+// onto the right local webrtc.Track without a second round trip.
+type trackKind byte
+
+const (
+	trackAudio trackKind = iota
+	trackVideo
+)
+
+// trackKindForCodec maps a negotiated codec name to the trackKind used on
+// the wire. Unknown codecs are treated as audio, matching prior behaviour
+// for Opus-only channels.
+func trackKindForCodec(codecName string) trackKind {
+	switch codecName {
+	case webrtc.VP8, webrtc.VP9, webrtc.H264:
+		return trackVideo
+	default:
+		return trackAudio
+	}
+}
+
+// depacketizerForCodec picks the rtp.Depacketizer matching a negotiated
+// codec so the samplebuilder can reassemble samples regardless of whether
+// the incoming track is audio or video.
+func depacketizerForCodec(codecName string) rtp.Depacketizer {
+	switch codecName {
+	case webrtc.VP8:
+		return &codecs.VP8Packet{}
+	case webrtc.VP9:
+		return &codecs.VP9Packet{}
+	case webrtc.H264:
+		return &codecs.H264Packet{}
+	default:
+		return &codecs.OpusPacket{}
+	}
+}
+
+func (k trackKind) String() string {
+	switch k {
+	case trackAudio:
+		return "audio"
+	case trackVideo:
+		return "video"
+	default:
+		return "unknown"
+	}
+}
+
+// parseTrackKind maps the track kind names used in CmdConnect.Tracks to a
+// trackKind.
+func parseTrackKind(name string) (trackKind, error) {
+	switch name {
+	case "audio":
+		return trackAudio, nil
+	case "video":
+		return trackVideo, nil
+	default:
+		return 0, fmt.Errorf("unknown track kind '%s'", name)
+	}
+}
+
+func containsKind(kinds []trackKind, want trackKind) bool {
+	for _, k := range kinds {
+		if k == want {
+			return true
+		}
+	}
+	return false
+}
+
 type Conn struct {
 	sync.Mutex
 
@@ -62,10 +145,30 @@ type Conn struct {
 	infoChan      chan string
 	trackQuitChan chan struct{}
 
+	// dropping tracks, per trackKind, whether RTCP Receiver Reports show
+	// this subscriber losing too much to keep sending it samples.
+	dropping    map[trackKind]bool
+	lastLossLog map[trackKind]time.Time
+
+	// trackRegistered remembers which trackKinds this publisher has already
+	// told the registry it's sending, so rtcTrackHandler doesn't re-announce
+	// it on every packet.
+	trackRegistered map[trackKind]bool
+
+	// sampleQueues holds one buffered channel per negotiated track kind for
+	// a subscriber, each drained by its own sampleConsumer goroutine. This
+	// keeps a slow WebRTC write on one track from ever blocking the shared
+	// bus read loop that demuxes samples for every track kind.
+	sampleQueues map[trackKind]chan media.Sample
+
 	logger *log.Logger
 
 	isPublisher bool
-	hasClosed   bool
+	// subscribed is only set once reg.AddSubscriber has actually succeeded
+	// for this conn, so Close doesn't decrement another conn's subscriber
+	// count when this one failed setup before ever registering.
+	subscribed bool
+	hasClosed  bool
 }
 
 func NewConn(ws *websocket.Conn) *Conn {
@@ -73,6 +176,10 @@ func NewConn(ws *websocket.Conn) *Conn {
 	c.errChan = make(chan error)
 	c.infoChan = make(chan string)
 	c.trackQuitChan = make(chan struct{})
+	c.dropping = make(map[trackKind]bool)
+	c.lastLossLog = make(map[trackKind]time.Time)
+	c.trackRegistered = make(map[trackKind]bool)
+	c.sampleQueues = make(map[trackKind]chan media.Sample)
 	c.logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
 	// wrap Gorilla conn with our conn so we can extend functionality
 	c.wsConn = ws
@@ -135,8 +242,13 @@ func (c *Conn) connectPublisher(ctx context.Context, cmd CmdConnect) error {
 		return fmt.Errorf("incorrect password")
 	}
 
+	if !isLocalShardOwner(cmd.Channel) {
+		return fmt.Errorf("channel '%s' is sharded to a different node; retry against its shard owner", cmd.Channel)
+	}
+
 	c.Lock()
 	c.channelName = cmd.Channel
+	c.isPublisher = true
 	c.Unlock()
 	c.Log("setting up publisher for channel '%s'\n", c.channelName)
 
@@ -146,7 +258,7 @@ func (c *Conn) connectPublisher(ctx context.Context, cmd CmdConnect) error {
 	c.spSock = pubSocket
 	c.Unlock()
 
-	if err := reg.AddPublisher(c.channelName); err != nil {
+	if err := reg.AddPublisher(c.channelName, c); err != nil {
 		return err
 	}
 
@@ -171,6 +283,19 @@ func (c *Conn) connectSubscriber(ctx context.Context, cmd CmdConnect) error {
 
 	c.channelName = cmd.Channel
 
+	// log a warning if the subscriber asks for a track the publisher isn't
+	// currently sending; this only logs on the server and doesn't change
+	// which local tracks the subscriber has
+	for _, wanted := range cmd.Tracks {
+		kind, err := parseTrackKind(wanted)
+		if err != nil {
+			return err
+		}
+		if !containsKind(reg.ChannelTracks(c.channelName), kind) {
+			c.Log("warning: requested track '%s' not currently published on channel '%s'\n", wanted, c.channelName)
+		}
+	}
+
 	c.Log("setting up subscriber for channel '%s'\n", c.channelName)
 	c.Lock()
 	if c.spSock, err = sub.NewSocket(); err != nil {
@@ -178,9 +303,16 @@ func (c *Conn) connectSubscriber(ctx context.Context, cmd CmdConnect) error {
 		return fmt.Errorf("can't get new sub socket: %s", err)
 	}
 	c.Unlock()
-	if err = c.spSock.Dial("inproc://babelcast/"); err != nil {
+	if err = c.spSock.Dial(busURL); err != nil {
 		return fmt.Errorf("sub can't dial %s", err)
 	}
+	// also dial every peer node's bus, so samples from a publisher pinned
+	// to another node reach this subscriber
+	for _, peerURL := range peerURLs {
+		if err := c.spSock.Dial(peerURL); err != nil {
+			c.Log("sub can't dial peer %s: %s\n", peerURL, err)
+		}
+	}
 
 	c.setTopic(c.channelName)
 	c.Lock()
@@ -193,6 +325,24 @@ func (c *Conn) connectSubscriber(ctx context.Context, cmd CmdConnect) error {
 	if err = reg.AddSubscriber(c.channelName); err != nil {
 		return err
 	}
+	c.Lock()
+	c.subscribed = true
+	c.Unlock()
+
+	// give each negotiated track its own small consumer goroutine reading
+	// off its own buffered queue, so one subscriber's slow/struggling track
+	// can never hold up demuxing the shared bus read loop below
+	for kind, track := range c.rtcPeer.tracks {
+		queue := make(chan media.Sample, sampleQueueLen)
+		c.Lock()
+		c.sampleQueues[kind] = queue
+		c.Unlock()
+		c.sampleConsumer(kind, track, queue)
+	}
+
+	for kind, sender := range c.rtcPeer.senders {
+		c.rtcpReaderHandler(kind, sender)
+	}
 
 	go func() {
 		defer c.Log("sub read goroutine quitting...\n")
@@ -215,12 +365,31 @@ func (c *Conn) connectSubscriber(ctx context.Context, cmd CmdConnect) error {
 				continue
 			}
 
+			// topic (4 bytes) + track kind (1 byte) + sample count (4 bytes) + payload;
+			// busURL may be a tcp:///tls:// socket any reachable peer can
+			// publish to, so a short/garbage message must not panic this
+			// goroutine and take every subscriber on the node down with it
+			if len(data) < 9 {
+				continue
+			}
+
 			// discard topic data[:4]
+			kind := trackKind(data[4])
 			sample := media.Sample{}
-			sample.Samples = binary.LittleEndian.Uint32(data[4:8])
-			sample.Data = data[8:]
+			sample.Samples = binary.LittleEndian.Uint32(data[5:9])
+			sample.Data = data[9:]
 
-			c.rtcPeer.track.WriteSample(sample)
+			queue, ok := c.sampleQueues[kind]
+			if !ok {
+				// this subscriber didn't negotiate a track for this kind
+				continue
+			}
+			select {
+			case queue <- sample:
+			default:
+				// this subscriber's consumer is falling behind; drop rather
+				// than block the recv loop every other subscriber shares
+			}
 		}
 	}()
 
@@ -239,6 +408,13 @@ func (c *Conn) Close() {
 	if c.rtcPeer != nil {
 		c.rtcPeer.Close()
 	}
+	if c.channelName != "" {
+		if c.isPublisher {
+			reg.RemovePublisher(c.channelName, c)
+		} else if c.subscribed {
+			reg.RemoveSubscriber(c.channelName)
+		}
+	}
 	if c.spSock != nil && !c.isPublisher {
 		c.spSock.Close()
 	}
@@ -263,12 +439,157 @@ func (c *Conn) writeMsg(val interface{}) error {
 	return nil
 }
 
+// rtcpReaderHandler drains RTCP from sender (a subscriber's local outgoing
+// track) and feeds Receiver Report loss into an
+// estimator for kind. When loss for a video track gets bad we also ask the
+// publisher to send a fresh keyframe via PLI, since a subscriber that's
+// losing packets on a predicted frame will otherwise never recover.
+func (c *Conn) rtcpReaderHandler(kind trackKind, sender *webrtc.RTPSender) {
+	go func() {
+		est := estimator.New()
+		defer c.Log("rtcp reader goroutine quitting (track=%v)...\n", kind)
+		for {
+			select {
+			case <-c.trackQuitChan:
+				return
+			default:
+			}
+			pkts, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				rr, ok := pkt.(*rtcp.ReceiverReport)
+				if !ok {
+					continue
+				}
+				for _, report := range rr.Reports {
+					est.Update(report.FractionLost)
+				}
+			}
+
+			drop := est.ShouldDrop()
+			c.setDropping(kind, drop)
+			if !drop {
+				continue
+			}
+
+			c.Lock()
+			shouldLog := time.Since(c.lastLossLog[kind]) > lossLogInterval
+			if shouldLog {
+				c.lastLossLog[kind] = time.Now()
+			}
+			c.Unlock()
+			if shouldLog {
+				c.Log("high loss (%.1f%%) on track=%v for channel '%s'\n", est.LossPercent(), kind, c.channelName)
+			}
+
+			if kind == trackVideo {
+				if pubConn := reg.PublisherConn(c.channelName); pubConn != nil {
+					pubConn.sendPLI()
+				}
+			}
+		}
+	}()
+}
+
+// isDropping reports whether samples for kind should currently be shed for
+// this subscriber due to sustained RTCP-reported loss.
+func (c *Conn) isDropping(kind trackKind) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.dropping[kind]
+}
+
+func (c *Conn) setDropping(kind trackKind, dropping bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.dropping[kind] = dropping
+}
+
+// sampleConsumer drains queue and writes each sample to track, skipping
+// samples while isDropping reports RTCP-driven backpressure. It exits once
+// trackQuitChan is closed or queue is, whichever comes first.
+func (c *Conn) sampleConsumer(kind trackKind, track *webrtc.Track, queue chan media.Sample) {
+	go func() {
+		defer c.Log("sample consumer goroutine quitting (track=%v)...\n", kind)
+		for {
+			select {
+			case <-c.trackQuitChan:
+				return
+			case sample, ok := <-queue:
+				if !ok {
+					return
+				}
+				if c.isDropping(kind) {
+					// RTCP receiver reports show this subscriber is losing
+					// too many packets already; shed samples rather than
+					// pile more onto a link that can't keep up
+					continue
+				}
+				track.WriteSample(sample)
+			}
+		}
+	}()
+}
+
+// sendPLI asks a publisher's peer connection to send a fresh keyframe,
+// called when a downstream subscriber is losing too much of the current one
+// to recover on its own.
+func (c *Conn) sendPLI() {
+	if c.rtcPeer == nil {
+		return
+	}
+	for _, ssrc := range c.rtcPeer.videoSSRCs() {
+		c.rtcPeer.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+	}
+}
+
+// rtcpPublisherLogger drains RTCP off a publisher's RTPReceiver so the
+// kernel buffer doesn't fill up, and logs any loss a publisher's own link
+// is reporting back to itself.
+func (c *Conn) rtcpPublisherLogger(receiver *webrtc.RTPReceiver) {
+	go func() {
+		defer c.Log("rtcp publisher reader goroutine quitting...\n")
+		buf := make([]byte, 1500)
+		for {
+			select {
+			case <-c.trackQuitChan:
+				return
+			default:
+			}
+			n, err := receiver.Read(buf)
+			if err != nil {
+				return
+			}
+			pkts, err := rtcp.Unmarshal(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, pkt := range pkts {
+				rr, ok := pkt.(*rtcp.ReceiverReport)
+				if !ok {
+					continue
+				}
+				for _, report := range rr.Reports {
+					if report.FractionLost > 0 {
+						c.Log("publisher link loss: %.1f%%\n", float64(report.FractionLost)/255*100)
+					}
+				}
+			}
+		}
+	}()
+}
+
 // WebRTC callback function
 func (c *Conn) rtcTrackHandler(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+	c.rtcpPublisherLogger(receiver)
 	go func() {
 		var err error
-		sb := samplebuilder.New(maxLate, &codecs.OpusPacket{})
-		defer c.Log("rtcTrackhandler goroutine quitting...\n")
+		codecName := track.Codec().Name
+		kind := trackKindForCodec(codecName)
+		sb := samplebuilder.New(maxLate, depacketizerForCodec(codecName))
+		defer c.Log("rtcTrackhandler goroutine quitting (track=%s)...\n", codecName)
 		defer c.Close()
 		for {
 			select {
@@ -288,6 +609,10 @@ func (c *Conn) rtcTrackHandler(track *webrtc.Track, receiver *webrtc.RTPReceiver
 				c.Unlock()
 				continue
 			}
+			if !c.trackRegistered[kind] {
+				c.trackRegistered[kind] = true
+				reg.AddPublisherTrack(c.channelName, kind)
+			}
 			c.Unlock()
 			// packet goes into samplebuilder, next valid sample comes out
 			sb.Push(p)
@@ -296,8 +621,10 @@ func (c *Conn) rtcTrackHandler(track *webrtc.Track, receiver *webrtc.RTPReceiver
 				continue
 			}
 			c.Lock()
-			// mangoes socket requires []byte where leading bytes is the subscription topic
+			// mangoes socket requires []byte where leading bytes is the subscription topic,
+			// followed by a single track-kind byte so subscribers can route to the right track
 			buf := bytes.NewBuffer(c.spTopic)
+			buf.WriteByte(byte(kind))
 			binary.Write(buf, binary.LittleEndian, sample.Samples)
 			buf.Write(sample.Data)
 			if err = c.spSock.Send(buf.Bytes()); err != nil {
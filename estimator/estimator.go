@@ -0,0 +1,72 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package estimator tracks packet loss for a single RTP sender from the
+// RTCP Receiver Reports it gets back, smoothing out single bad reports so
+// callers can make backpressure decisions off a stable signal.
+package estimator
+
+import "sync"
+
+// dropThreshold is the smoothed loss fraction, out of 256 (matching RTCP's
+// fraction lost field), above which a subscriber is considered struggling.
+const dropThreshold = 25 // ~10%
+
+// smoothing is the weight given to each new report vs the running average.
+const smoothing = 0.25
+
+// Estimator keeps a smoothed view of fraction-lost, as reported in RTCP
+// Receiver Reports, for one RTP sender.
+type Estimator struct {
+	mu      sync.Mutex
+	avgLost float64
+	seen    bool
+}
+
+// New returns an Estimator with no history; the first report sets the
+// baseline rather than being smoothed against a zero average.
+func New() *Estimator {
+	return &Estimator{}
+}
+
+// Update folds a Receiver Report's fraction-lost (0-255, where 255 means
+// the full interval was lost) into the running average.
+func (e *Estimator) Update(fractionLost uint8) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	lost := float64(fractionLost)
+	if !e.seen {
+		e.avgLost = lost
+		e.seen = true
+		return
+	}
+	e.avgLost = e.avgLost + smoothing*(lost-e.avgLost)
+}
+
+// ShouldDrop reports whether the smoothed loss rate is high enough that the
+// caller should start shedding samples for this subscriber.
+func (e *Estimator) ShouldDrop() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.seen && e.avgLost > dropThreshold
+}
+
+// LossPercent returns the smoothed loss rate as a 0-100 percentage, for
+// logging.
+func (e *Estimator) LossPercent() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.avgLost / 255 * 100
+}
@@ -0,0 +1,155 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// snapshotInterval is how often eventHub pushes a full directory snapshot to
+// listeners, independent of any AddPublisher/AddSubscriber activity.
+const snapshotInterval = 30 * time.Second
+
+// listenerQueueLen bounds how many events a single slow websocket reader can
+// fall behind by before we start dropping events for it. The data path
+// (sample forwarding) must never block on a listener falling behind.
+const listenerQueueLen = 32
+
+// channelEvent describes a single change in live channel occupancy, pushed
+// to every listener subscribed via /events.
+type channelEvent struct {
+	Type         string `json:"type"` // "publisher_joined", "publisher_left", "subscriber_joined", "subscriber_left", "tracks_changed", "snapshot"
+	Channel      string `json:"channel,omitempty"`
+	HasPublisher bool   `json:"has_publisher"`
+	Subscribers  int    `json:"subscribers"`
+	// Tracks lists the track kinds ("audio", "video") the channel's
+	// publisher is currently sending, so a client can watch /events and
+	// learn what to negotiate before it ever builds its own SDP offer.
+	Tracks []string  `json:"tracks,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// eventHub fans out registry changes to any number of connected listeners.
+// Each listener gets its own buffered queue so a slow reader can only drop
+// its own events, never block AddPublisher/AddSubscriber for everyone else.
+type eventHub struct {
+	mu        sync.Mutex
+	listeners map[chan channelEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		listeners: make(map[chan channelEvent]struct{}),
+	}
+}
+
+// subscribe registers a new listener and returns its queue plus an unsubscribe
+// func the caller must invoke when done reading.
+func (h *eventHub) subscribe() (chan channelEvent, func()) {
+	ch := make(chan channelEvent, listenerQueueLen)
+	h.mu.Lock()
+	h.listeners[ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		delete(h.listeners, ch)
+		h.mu.Unlock()
+		close(ch)
+	}
+	return ch, unsubscribe
+}
+
+// publish fans an event out to every listener. A listener whose queue is
+// full has its event dropped rather than blocking the publisher.
+func (h *eventHub) publish(ev channelEvent) {
+	ev.Time = timeNow()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.listeners {
+		select {
+		case ch <- ev:
+		default:
+			// slow reader, drop this event for it
+		}
+	}
+}
+
+// timeNow is a var so tests can stub the clock.
+var timeNow = time.Now
+
+// eventsUpgrader matches the websocket upgrader used elsewhere for WS
+// handshakes.
+var eventsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// eventsHandler upgrades to a websocket and streams channelEvents for as
+// long as the client stays connected: one message per registry change, plus
+// a periodic full snapshot so a newly connected client doesn't have to wait
+// for the next change to learn current occupancy.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := eventsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("events: upgrade failed: %s\n", err)
+		return
+	}
+	defer ws.Close()
+
+	events, unsubscribe := reg.events.subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	// send an initial snapshot immediately so clients don't wait up to
+	// snapshotInterval to learn current occupancy
+	for _, ev := range reg.snapshot() {
+		if err := ws.WriteJSON(ev); err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := ws.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			for _, ev := range reg.snapshot() {
+				if err := ws.WriteJSON(ev); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (ev channelEvent) String() string {
+	j, _ := json.Marshal(ev)
+	return string(j)
+}
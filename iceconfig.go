@@ -0,0 +1,97 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pion/webrtc/v2"
+)
+
+var iceConfigPath string
+
+func init() {
+	flag.StringVar(&iceConfigPath, "ice-config", os.Getenv("BABELCAST_ICE_CONFIG"),
+		"path to a JSON file containing a list of webrtc.ICEServer entries (STUN/TURN)")
+}
+
+var (
+	iceServersMu  sync.RWMutex
+	iceServers    []webrtc.ICEServer
+	iceConfigOnce sync.Once
+)
+
+// setupICEConfig loads the ICE server list once at startup and, if a config
+// path was given, installs a SIGHUP handler so operators can rotate TURN
+// credentials without restarting babelcast.
+func setupICEConfig() {
+	iceConfigOnce.Do(func() {
+		if iceConfigPath == "" {
+			return
+		}
+		if err := reloadICEConfig(); err != nil {
+			log.Fatalf("ice-config: %s\n", err)
+		}
+
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go func() {
+			for range sighup {
+				if err := reloadICEConfig(); err != nil {
+					log.Printf("ice-config: reload failed, keeping previous config: %s\n", err)
+					continue
+				}
+				log.Printf("ice-config: reloaded from %s\n", iceConfigPath)
+			}
+		}()
+	})
+}
+
+// reloadICEConfig re-reads iceConfigPath and atomically swaps the cached
+// ICE server list used by NewPC.
+func reloadICEConfig() error {
+	f, err := os.Open(iceConfigPath)
+	if err != nil {
+		return fmt.Errorf("can't open %s: %s", iceConfigPath, err)
+	}
+	defer f.Close()
+
+	var servers []webrtc.ICEServer
+	if err := json.NewDecoder(f).Decode(&servers); err != nil {
+		return fmt.Errorf("can't parse %s: %s", iceConfigPath, err)
+	}
+
+	iceServersMu.Lock()
+	iceServers = servers
+	iceServersMu.Unlock()
+
+	return nil
+}
+
+// currentICEServers returns the most recently loaded ICE server list, for
+// use by NewPC when building the webrtc.Configuration passed to
+// webrtc.NewPeerConnection.
+func currentICEServers() []webrtc.ICEServer {
+	iceServersMu.RLock()
+	defer iceServersMu.RUnlock()
+	return iceServers
+}
@@ -0,0 +1,194 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/pub"
+)
+
+const (
+	PingInterval = 5 * time.Second
+	WriteWait    = 5 * time.Second
+)
+
+var (
+	listenAddr        string
+	publisherPassword string
+)
+
+func init() {
+	flag.StringVar(&listenAddr, "listen", ":8080", "address to listen for websocket connections on")
+	flag.StringVar(&publisherPassword, "publisher-password", os.Getenv("BABELCAST_PUBLISHER_PASSWORD"), "password publishers must supply to connect")
+}
+
+// CmdSession carries the initial WebRTC offer for a websocket session,
+// before the caller has said whether it's publishing or subscribing.
+type CmdSession struct {
+	SessionDescription string `json:"sd"`
+}
+
+// CmdConnect attaches an already-established session to a channel, either
+// as its publisher or as a subscriber.
+type CmdConnect struct {
+	Channel  string `json:"channel"`
+	Password string `json:"password,omitempty"`
+	// Tracks lists which track kinds ("audio", "video") a subscriber wants
+	// to receive; it does not filter anything, as the subscriber gets
+	// samples for every track its offer negotiated. Checked against the registry's per-channel track list purely
+	// to warn if a wanted track isn't being published; a subscriber's local
+	// WebRTCPeer tracks are fixed by its own SDP offer before this command
+	// is ever processed, so a client that cares should watch /events (whose
+	// channelEvent.Tracks carries this same list) before building that
+	// offer, not rely on this field to allocate anything.
+	Tracks []string `json:"tracks,omitempty"`
+}
+
+// wsMsg is the envelope every message on the websocket is wrapped in, in
+// both directions.
+type wsMsg struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// pubSocket is the mangos socket every publisher's samples are sent on; it
+// is shared across all publisher Conns in this process.
+var pubSocket mangos.Socket
+
+// setupBus starts the sample bus: pubSocket listens on busURL for
+// subscribers to dial, both local ones and those on peer nodes that list
+// this node in their -peer flags, and also dials any configured peers.
+func setupBus() {
+	var err error
+	pubSocket, err = pub.NewSocket()
+	if err != nil {
+		log.Fatalf("can't create pub socket: %s\n", err)
+	}
+	if err = pubSocket.Listen(busURL); err != nil {
+		log.Fatalf("pub socket can't listen on %s: %s\n", busURL, err)
+	}
+	for _, peerURL := range peerURLs {
+		if err := pubSocket.Dial(peerURL); err != nil {
+			log.Printf("pub socket can't dial peer %s: %s\n", peerURL, err)
+		}
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// wsHandler upgrades to a websocket and dispatches each incoming wsMsg to
+// the Conn method matching its key.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("ws upgrade failed: %s\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewConn(ws)
+	defer c.Close()
+
+	go c.LogHandler(ctx)
+	go c.PingHandler(ctx)
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg wsMsg
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.errChan <- fmt.Errorf("can't unmarshal message: %s", err)
+			continue
+		}
+
+		switch msg.Key {
+		case "session":
+			var cmd CmdSession
+			if err := json.Unmarshal(msg.Value, &cmd); err != nil {
+				c.errChan <- fmt.Errorf("can't unmarshal session cmd: %s", err)
+				continue
+			}
+			if err := c.setupSession(ctx, cmd); err != nil {
+				c.errChan <- err
+			}
+		case "publish":
+			var cmd CmdConnect
+			if err := json.Unmarshal(msg.Value, &cmd); err != nil {
+				c.errChan <- fmt.Errorf("can't unmarshal connect cmd: %s", err)
+				continue
+			}
+			if err := c.connectPublisher(ctx, cmd); err != nil {
+				c.errChan <- err
+			}
+		case "subscribe":
+			var cmd CmdConnect
+			if err := json.Unmarshal(msg.Value, &cmd); err != nil {
+				c.errChan <- fmt.Errorf("can't unmarshal connect cmd: %s", err)
+				continue
+			}
+			if err := c.connectSubscriber(ctx, cmd); err != nil {
+				c.errChan <- err
+			}
+		default:
+			c.errChan <- fmt.Errorf("unknown command key '%s'", msg.Key)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	requireNodeID()
+
+	setupICEConfig()
+	setupBus()
+	autoStartRecordings()
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigterm
+		log.Println("shutting down, flushing recordings...")
+		stopAllRecordings()
+		os.Exit(0)
+	}()
+
+	http.HandleFunc("/ws", wsHandler)
+	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/admin/record", recordAdminHandler)
+
+	log.Printf("babelcast listening on %s\n", listenAddr)
+	log.Fatal(http.ListenAndServe(listenAddr, nil))
+}
@@ -0,0 +1,208 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package recorder subscribes to a channel's samples on the mangos bus and
+// writes them to rotating Ogg/Opus files on disk, so a channel can be
+// captured without a WebRTC subscriber ever connecting.
+package recorder
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2/pkg/media/oggwriter"
+	"go.nanomsg.org/mangos/v3"
+	"go.nanomsg.org/mangos/v3/protocol/sub"
+)
+
+// sampleRate and channels match the Opus format babelcast negotiates for
+// every publisher.
+const (
+	sampleRate = 48000
+	channels   = 2
+)
+
+// trackAudioByte is the wire value of trackAudio (package main's
+// trackKind enum, value 0); duplicated here since this package can't
+// import package main.
+const trackAudioByte = 0
+
+// Recording is one in-progress capture of a channel.
+type Recording struct {
+	mu sync.Mutex
+
+	channelName string
+	dir         string
+	maxDuration time.Duration
+
+	sock     mangos.Socket
+	writer   *oggwriter.OggWriter
+	fileName string
+	opened   time.Time
+
+	seq       uint16
+	timestamp uint32
+
+	closeSockOnce sync.Once
+	quit          chan struct{}
+	done          chan struct{}
+}
+
+// Start dials busURL, subscribes to topic (the same 4-byte channel hash
+// connectSubscriber uses), and begins writing samples for channelName into
+// dir, rotating to a new file every maxDuration.
+func Start(busURL, channelName string, topic []byte, dir string, maxDuration time.Duration) (*Recording, error) {
+	sock, err := sub.NewSocket()
+	if err != nil {
+		return nil, fmt.Errorf("recorder: can't get new sub socket: %s", err)
+	}
+	if err = sock.Dial(busURL); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("recorder: sub can't dial %s: %s", busURL, err)
+	}
+	if err = sock.SetOption(mangos.OptionSubscribe, topic); err != nil {
+		sock.Close()
+		return nil, fmt.Errorf("recorder: sub can't subscribe: %s", err)
+	}
+
+	r := &Recording{
+		channelName: channelName,
+		dir:         dir,
+		maxDuration: maxDuration,
+		sock:        sock,
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if err := r.rotate(); err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	go r.run()
+	return r, nil
+}
+
+// Stop flushes and closes the current file and stops the recording. It
+// blocks until the write goroutine has exited.
+func (r *Recording) Stop() {
+	close(r.quit)
+	// run() blocks in sock.Recv(), which only returns once the socket is
+	// closed; without this, Stop would hang forever on a channel with no
+	// active publisher sending samples to wake the read loop.
+	r.closeSock()
+	<-r.done
+}
+
+func (r *Recording) closeSock() {
+	r.closeSockOnce.Do(func() {
+		r.sock.Close()
+	})
+}
+
+// FileName returns the path of the file currently being written.
+func (r *Recording) FileName() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fileName
+}
+
+func (r *Recording) run() {
+	defer close(r.done)
+	defer r.closeWriter()
+	defer r.closeSock()
+
+	for {
+		select {
+		case <-r.quit:
+			return
+		default:
+		}
+
+		data, err := r.sock.Recv()
+		if err != nil {
+			if err == mangos.ErrClosed {
+				return
+			}
+			continue
+		}
+		// topic (4 bytes) + track kind (1 byte) + sample count (4 bytes) + payload
+		if len(data) < 9 {
+			continue
+		}
+		// only trackAudio (0) is Opus; a video track on the same channel
+		// would otherwise get spliced straight into the Ogg/Opus file
+		if data[4] != trackAudioByte {
+			continue
+		}
+
+		r.mu.Lock()
+		if time.Since(r.opened) > r.maxDuration {
+			if err := r.rotate(); err != nil {
+				r.mu.Unlock()
+				return
+			}
+		}
+		// oggwriter writes RTP packets, not raw samples, so we wrap the
+		// already-depacketized payload back into a minimal packet; only the
+		// sequence number and timestamp progression matter for Ogg framing.
+		numSamples := uint32(data[5]) | uint32(data[6])<<8 | uint32(data[7])<<16 | uint32(data[8])<<24
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: r.seq,
+				Timestamp:      r.timestamp,
+			},
+			Payload: data[9:],
+		}
+		r.seq++
+		r.timestamp += numSamples
+		err = r.writer.WriteRTP(pkt)
+		r.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rotate closes the current file, if any, and opens a new one named
+// <channel>-<RFC3339>.ogg under dir. Callers must hold r.mu.
+func (r *Recording) rotate() error {
+	r.closeWriter()
+
+	name := fmt.Sprintf("%s-%s.ogg", r.channelName, time.Now().UTC().Format(time.RFC3339))
+	path := filepath.Join(r.dir, name)
+
+	w, err := oggwriter.New(path, sampleRate, channels)
+	if err != nil {
+		return fmt.Errorf("recorder: can't open %s: %s", path, err)
+	}
+
+	r.writer = w
+	r.fileName = path
+	r.opened = time.Now()
+	r.seq = 0
+	r.timestamp = 0
+	return nil
+}
+
+func (r *Recording) closeWriter() {
+	if r.writer != nil {
+		r.writer.Close()
+		r.writer = nil
+	}
+}
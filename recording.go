@@ -0,0 +1,190 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forkkit/babelcast/recorder"
+)
+
+var (
+	recordDir         string
+	recordChannels    string
+	recordMaxDuration time.Duration
+)
+
+func init() {
+	flag.StringVar(&recordDir, "record-dir", "", "directory to write channel recordings to; recording is disabled if empty")
+	flag.StringVar(&recordChannels, "record-channels", "", "comma separated list of channels to record on startup, or * for all")
+	flag.DurationVar(&recordMaxDuration, "record-max-duration", time.Hour, "rotate to a new recording file after this long")
+}
+
+// recordings tracks the in-progress recorder.Recording for each channel
+// currently being captured, so the admin endpoint and shutdown handling can
+// find and stop them.
+var recordings = struct {
+	sync.Mutex
+	m map[string]*recorder.Recording
+}{m: make(map[string]*recorder.Recording)}
+
+// startRecording begins capturing channelName into recordDir, unless it is
+// already being recorded.
+func startRecording(channelName string) error {
+	recordings.Lock()
+	defer recordings.Unlock()
+
+	if recordDir == "" {
+		return fmt.Errorf("recording is disabled: -record-dir is not set")
+	}
+
+	if _, ok := recordings.m[channelName]; ok {
+		return fmt.Errorf("channel '%s' is already being recorded", channelName)
+	}
+
+	topic := make([]byte, 4)
+	topicUint := hash(channelName)
+	topic[0] = byte(topicUint)
+	topic[1] = byte(topicUint >> 8)
+	topic[2] = byte(topicUint >> 16)
+	topic[3] = byte(topicUint >> 24)
+
+	rec, err := recorder.Start(busURL, channelName, topic, recordDir, recordMaxDuration)
+	if err != nil {
+		return err
+	}
+
+	recordings.m[channelName] = rec
+	log.Printf("recorder: started recording channel '%s' to %s\n", channelName, rec.FileName())
+	return nil
+}
+
+// stopRecording stops capturing channelName, if it is being recorded.
+func stopRecording(channelName string) error {
+	recordings.Lock()
+	rec, ok := recordings.m[channelName]
+	if ok {
+		delete(recordings.m, channelName)
+	}
+	recordings.Unlock()
+
+	if !ok {
+		return fmt.Errorf("channel '%s' is not being recorded", channelName)
+	}
+	rec.Stop()
+	log.Printf("recorder: stopped recording channel '%s'\n", channelName)
+	return nil
+}
+
+// stopAllRecordings flushes and closes every in-progress recording; called
+// on SIGTERM so no recording is left with a truncated Ogg file.
+func stopAllRecordings() {
+	recordings.Lock()
+	channelNames := make([]string, 0, len(recordings.m))
+	for channelName := range recordings.m {
+		channelNames = append(channelNames, channelName)
+	}
+	recordings.Unlock()
+
+	for _, channelName := range channelNames {
+		stopRecording(channelName)
+	}
+}
+
+// recordAdminHandler lets an operator start/stop ad-hoc recording of a
+// channel without restarting babelcast. It is guarded by publisherPassword,
+// the same credential used to start a publisher session.
+func recordAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if publisherPassword != "" && r.FormValue("password") != publisherPassword {
+		http.Error(w, "incorrect password", http.StatusUnauthorized)
+		return
+	}
+
+	channelName := r.FormValue("channel")
+	if channelName == "" {
+		http.Error(w, "channel cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.FormValue("action") {
+	case "start":
+		err = startRecording(channelName)
+	case "stop":
+		err = stopRecording(channelName)
+	default:
+		http.Error(w, "action must be 'start' or 'stop'", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// autoStartRecordings begins recording every channel named in
+// -record-channels at startup, or, for "*", watches for every channel that
+// ever gets a publisher and starts recording each as it appears.
+func autoStartRecordings() {
+	if recordDir == "" || recordChannels == "" {
+		return
+	}
+	if err := os.MkdirAll(recordDir, 0755); err != nil {
+		log.Fatalf("recorder: can't create -record-dir %s: %s\n", recordDir, err)
+	}
+
+	if recordChannels == "*" {
+		watchAndRecordAllChannels()
+		return
+	}
+
+	for _, channelName := range strings.Split(recordChannels, ",") {
+		channelName = strings.TrimSpace(channelName)
+		if channelName == "" {
+			continue
+		}
+		if err := startRecording(channelName); err != nil {
+			log.Printf("recorder: %s\n", err)
+		}
+	}
+}
+
+// watchAndRecordAllChannels starts recording every channel that ever gets a
+// publisher, for the rest of the process lifetime. autoStartRecordings runs
+// at startup before any websocket has connected, so the registry is
+// always empty then; "*" only means something if it catches channels as
+// they show up later, via the same eventHub /events streams from.
+func watchAndRecordAllChannels() {
+	events, _ := reg.events.subscribe()
+	go func() {
+		for ev := range events {
+			if ev.Type != "publisher_joined" {
+				continue
+			}
+			if err := startRecording(ev.Channel); err != nil {
+				log.Printf("recorder: %s\n", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,189 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// channelState is everything the registry knows about one channel: who's
+// publishing, how many subscribers are listening, and which track kinds the
+// publisher is currently sending.
+type channelState struct {
+	publisherConn   *Conn
+	subscriberCount int
+	tracks          map[trackKind]bool
+}
+
+// registry tracks the live publisher/subscriber state of every channel and
+// fans out every change to anyone listening on /events.
+type registry struct {
+	mu       sync.Mutex
+	channels map[string]*channelState
+	events   *eventHub
+}
+
+// trackNames returns the track kind names in tracks, sorted so repeated
+// calls (and therefore repeated channelEvents) are stable.
+func trackNames(tracks map[trackKind]bool) []string {
+	names := make([]string, 0, len(tracks))
+	for kind := range tracks {
+		names = append(names, kind.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+var reg = newRegistry()
+
+func newRegistry() *registry {
+	return &registry{
+		channels: make(map[string]*channelState),
+		events:   newEventHub(),
+	}
+}
+
+// snapshot returns one channelEvent per known channel, reflecting its
+// current occupancy, for a newly-connected /events listener.
+func (r *registry) snapshot() []channelEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make([]channelEvent, 0, len(r.channels))
+	for channelName, ch := range r.channels {
+		events = append(events, channelEvent{
+			Type:         "snapshot",
+			Channel:      channelName,
+			HasPublisher: ch.publisherConn != nil,
+			Subscribers:  ch.subscriberCount,
+			Tracks:       trackNames(ch.tracks),
+		})
+	}
+	return events
+}
+
+// channel returns channelName's state, creating it if this is the first
+// we've heard of it. Callers must hold r.mu.
+func (r *registry) channel(channelName string) *channelState {
+	ch, ok := r.channels[channelName]
+	if !ok {
+		ch = &channelState{tracks: make(map[trackKind]bool)}
+		r.channels[channelName] = ch
+	}
+	return ch
+}
+
+// AddPublisher registers conn as channelName's publisher. It fails if the
+// channel already has one.
+func (r *registry) AddPublisher(channelName string, conn *Conn) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := r.channel(channelName)
+	if ch.publisherConn != nil {
+		return fmt.Errorf("channel '%s' already has a publisher", channelName)
+	}
+	ch.publisherConn = conn
+	r.events.publish(channelEvent{Type: "publisher_joined", Channel: channelName, HasPublisher: true, Subscribers: ch.subscriberCount, Tracks: trackNames(ch.tracks)})
+	return nil
+}
+
+// RemovePublisher clears conn as channelName's publisher, if it still is
+// one, and forgets which tracks it was sending.
+func (r *registry) RemovePublisher(channelName string, conn *Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, ok := r.channels[channelName]
+	if !ok || ch.publisherConn != conn {
+		return
+	}
+	ch.publisherConn = nil
+	ch.tracks = make(map[trackKind]bool)
+	r.events.publish(channelEvent{Type: "publisher_left", Channel: channelName, HasPublisher: false, Subscribers: ch.subscriberCount})
+}
+
+// AddPublisherTrack records that channelName's publisher is sending kind,
+// and publishes the updated track list so a subscriber watching /events
+// learns of it as soon as it's known, well before it needs to build its own
+// offer (tracks are usually only known a moment after AddPublisher, once
+// the publisher's first RTP packet of that kind arrives).
+func (r *registry) AddPublisherTrack(channelName string, kind trackKind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := r.channel(channelName)
+	if ch.tracks[kind] {
+		return
+	}
+	ch.tracks[kind] = true
+	r.events.publish(channelEvent{Type: "tracks_changed", Channel: channelName, HasPublisher: ch.publisherConn != nil, Subscribers: ch.subscriberCount, Tracks: trackNames(ch.tracks)})
+}
+
+// ChannelTracks returns the track kinds channelName's publisher is
+// currently sending.
+func (r *registry) ChannelTracks(channelName string) []trackKind {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, ok := r.channels[channelName]
+	if !ok {
+		return nil
+	}
+	kinds := make([]trackKind, 0, len(ch.tracks))
+	for kind := range ch.tracks {
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// AddSubscriber increments channelName's subscriber count.
+func (r *registry) AddSubscriber(channelName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := r.channel(channelName)
+	ch.subscriberCount++
+	r.events.publish(channelEvent{Type: "subscriber_joined", Channel: channelName, HasPublisher: ch.publisherConn != nil, Subscribers: ch.subscriberCount, Tracks: trackNames(ch.tracks)})
+	return nil
+}
+
+// RemoveSubscriber decrements channelName's subscriber count.
+func (r *registry) RemoveSubscriber(channelName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, ok := r.channels[channelName]
+	if !ok || ch.subscriberCount == 0 {
+		return
+	}
+	ch.subscriberCount--
+	r.events.publish(channelEvent{Type: "subscriber_left", Channel: channelName, HasPublisher: ch.publisherConn != nil, Subscribers: ch.subscriberCount, Tracks: trackNames(ch.tracks)})
+}
+
+// PublisherConn returns the Conn currently publishing channelName, or nil
+// if it has none.
+func (r *registry) PublisherConn(channelName string) *Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch, ok := r.channels[channelName]
+	if !ok {
+		return nil
+	}
+	return ch.publisherConn
+}
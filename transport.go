@@ -0,0 +1,99 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"strings"
+
+	_ "go.nanomsg.org/mangos/v3/transport/tcp"
+	_ "go.nanomsg.org/mangos/v3/transport/tls"
+)
+
+// busURL is the mangos address the sample bus listens on for publishers'
+// samples and subscribers dial to reach it. It defaults to the original single-process inproc transport;
+// pointing it at a tcp:// or tls:// address instead lets a cluster of
+// babelcast nodes share channels over the network.
+var busURL string
+
+// peerURLs is the list of additional bus addresses this node dials, so that
+// a publisher connected to one node can reach subscribers connected to
+// another. Pass -peer multiple times to add more peers.
+var peerURLs peerList
+
+// nodeID is this node's own stable identity within the cluster, e.g. the
+// same tcp://host:port other nodes dial to reach it. Every node must be
+// given the others' -peer addresses plus its own -node-id, so that all
+// nodes build the identical sorted node list isLocalShardOwner hashes
+// against; unlike "", a node's own address means the same thing in every
+// other node's view too.
+var nodeID string
+
+func init() {
+	flag.StringVar(&busURL, "bus-url", "inproc://babelcast/", "mangos address the sample bus listens on/dials (inproc://, tcp://, or tls://)")
+	flag.Var(&peerURLs, "peer", "additional bus address to dial, e.g. tcp://10.0.0.2:5555 (repeatable)")
+	flag.StringVar(&nodeID, "node-id", "", "this node's own address, as referenced in every peer's -peer list; required when -peer is set")
+}
+
+// requireNodeID fails startup if this node is clustered (-peer is set)
+// without a -node-id, since isLocalShardOwner can't compute a cluster-wide
+// consistent shard owner otherwise.
+func requireNodeID() {
+	if len(peerURLs) > 0 && nodeID == "" {
+		log.Fatal("-node-id is required when -peer is set, so every node hashes the same node list")
+	}
+}
+
+// peerList implements flag.Value to collect repeated -peer flags.
+type peerList []string
+
+func (p *peerList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *peerList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// shardOwner decides, by hashing the channel name, which peer (including
+// this node, addressed by its -node-id) owns a publisher for a given channel. This
+// keeps a channel's publisher pinned to a single node so its samples are
+// only ever published once, avoiding duplicate fan-out when every node
+// dials every other node's bus.
+func shardOwner(channelName string, nodes []string) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+	return nodes[hash(channelName)%uint32(len(nodes))]
+}
+
+// isLocalShardOwner reports whether this node is the shard owner for
+// channelName and should therefore accept its publisher locally, rather
+// than tell the publisher to retry against a different node. With no peers
+// configured every node owns every channel, matching single-process
+// behaviour. Every node in the cluster builds this same nodes list (its own
+// -node-id plus its -peer addresses), so they all agree on the owner.
+func isLocalShardOwner(channelName string) bool {
+	if len(peerURLs) == 0 {
+		return true
+	}
+
+	nodes := append([]string{nodeID}, []string(peerURLs)...)
+	sort.Strings(nodes)
+	return shardOwner(channelName, nodes) == nodeID
+}
@@ -0,0 +1,137 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// payload types for the local tracks we offer back to a peer; these match
+// the default dynamic payload types pion/webrtc negotiates for Opus/VP8.
+const (
+	payloadTypeOpus uint8 = 111
+	payloadTypeVP8  uint8 = 96
+)
+
+// WebRTCPeer wraps a pion PeerConnection together with the local tracks we
+// add to it, keyed by trackKind so Conn can look up the right track/sender
+// when demuxing samples off the bus or reading RTCP.
+type WebRTCPeer struct {
+	pc      *webrtc.PeerConnection
+	tracks  map[trackKind]*webrtc.Track
+	senders map[trackKind]*webrtc.RTPSender
+}
+
+// NewPC builds a PeerConnection for a new websocket session. It adds a
+// local audio track, and a local video track too if offer negotiates one,
+// so the peer has somewhere to receive samples if it ends up a subscriber;
+// onTrack fires for whatever the remote side sends if it ends up a
+// publisher. Which role the session takes is decided later, by whichever
+// of connectPublisher/connectSubscriber the client calls.
+func NewPC(offer string, onICEStateChange func(webrtc.ICEConnectionState), onTrack func(*webrtc.Track, *webrtc.RTPReceiver)) (*WebRTCPeer, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{
+		ICEServers: currentICEServers(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't create peer connection: %s", err)
+	}
+
+	p := &WebRTCPeer{
+		pc:      pc,
+		tracks:  make(map[trackKind]*webrtc.Track),
+		senders: make(map[trackKind]*webrtc.RTPSender),
+	}
+
+	pc.OnICEConnectionStateChange(onICEStateChange)
+	pc.OnTrack(onTrack)
+
+	if _, err := p.addLocalTrack(trackAudio, payloadTypeOpus, "audio"); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	// only add a local video track if the offer actually negotiates one, so
+	// audio-only publishers/subscribers don't pay for an unused m= section
+	if offerHasVideo(offer) {
+		if _, err := p.addLocalTrack(trackVideo, payloadTypeVP8, "video"); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("can't set remote description: %s", err)
+	}
+
+	return p, nil
+}
+
+// addLocalTrack creates a local track of kind and adds it to the
+// PeerConnection, recording both the track and the RTPSender it returns so
+// Conn can write samples to it and read RTCP feedback from it later.
+func (p *WebRTCPeer) addLocalTrack(kind trackKind, payloadType uint8, id string) (*webrtc.Track, error) {
+	track, err := p.pc.NewTrack(payloadType, rand.Uint32(), id, id)
+	if err != nil {
+		return nil, fmt.Errorf("can't create local %s track: %s", id, err)
+	}
+
+	sender, err := p.pc.AddTrack(track)
+	if err != nil {
+		return nil, fmt.Errorf("can't add local %s track: %s", id, err)
+	}
+
+	p.tracks[kind] = track
+	p.senders[kind] = sender
+	return track, nil
+}
+
+// offerHasVideo reports whether offer negotiates a video media section, so
+// NewPC knows whether to allocate a local video track for it.
+func offerHasVideo(offer string) bool {
+	for _, line := range strings.Split(offer, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "m=video") {
+			return true
+		}
+	}
+	return false
+}
+
+// videoSSRCs returns the SSRCs of the video tracks the remote peer is
+// sending on this connection, for addressing a PLI at them.
+func (p *WebRTCPeer) videoSSRCs() []uint32 {
+	var ssrcs []uint32
+	for _, receiver := range p.pc.GetReceivers() {
+		track := receiver.Track()
+		if track == nil || track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		ssrcs = append(ssrcs, track.SSRC())
+	}
+	return ssrcs
+}
+
+func (p *WebRTCPeer) Close() {
+	if p.pc != nil {
+		p.pc.Close()
+	}
+}